@@ -10,10 +10,20 @@ import (
 func main() {
 	localPort := flag.Int("port", 8080, "Local port to forward to")
 	subdomain := flag.String("subdomain", "", "Request a specific subdomain")
+	mode := flag.String("mode", "http", "Tunnel mode: \"http\" (route by subdomain) or \"tcp\" (raw byte stream)")
+	listenPort := flag.Int("listen-port", 0, "Server-side port to bind for \"tcp\" mode")
+	user := flag.String("user", "", "Username, for servers started with -auth=static or -auth=file")
+	pass := flag.String("pass", "", "Password, for servers started with -auth=static or -auth=file")
+	token := flag.String("token", "", "Bearer token, for servers authenticating by token")
 	flag.Parse()
 
 	serverURL := "https://server.publictunnel.com"
 	c := client.NewTunnelClient(serverURL, *localPort, *subdomain)
+	c.Mode = *mode
+	c.ListenPort = *listenPort
+	c.User = *user
+	c.Pass = *pass
+	c.Token = *token
 	if err := c.Start(); err != nil {
 		log.Fatalf("Client failed: %v", err)
 	}
@@ -3,17 +3,50 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
-	"github.com/dachi-pa/publictunnel/internal/server"
+	"github.com/dachinat/publictunnel/internal/auth"
+	"github.com/dachinat/publictunnel/internal/server"
+	"github.com/dachinat/publictunnel/internal/tlsmgr"
 )
 
 func main() {
 	domain := flag.String("domain", "server.publictunnel.com", "Main domain for the server API")
 	tunnelDomain := flag.String("tunnel-domain", "publictunnel.com", "Base domain for the tunnels")
-	port := flag.Int("port", 4000, "Port to run the server on")
+	port := flag.Int("port", 4000, "Port to run the server on (ignored when -tls is set; TLS always serves :443/:80)")
+	authSpec := flag.String("auth", "none", "Client auth: \"none\", \"static:user:pass\", \"file:/path/to/users\", or \"token:/path/to/tokens\"")
+	reconnectSecretPath := flag.String("reconnect-secret", "reconnect.secret", "Path to the file storing the HMAC secret for reconnect tokens (created on first run)")
+	reconnectGrace := flag.Duration("reconnect-grace", 30*time.Second, "How long an orphaned client's subdomain slot is held open, and in-flight requests queued, waiting for a reconnect")
+	useTLS := flag.Bool("tls", false, "Terminate TLS with an automatic Let's Encrypt wildcard certificate for *.tunnel-domain")
+	tlsCacheDir := flag.String("tls-cache-dir", "tls-cache", "Directory for the cached ACME certificate, used with -tls")
+	acmeEmail := flag.String("acme-email", "", "Contact email for the ACME account, required with -tls")
+	dnsProvider := flag.String("dns-provider", "manual", "DNS-01 provider for wildcard issuance, used with -tls: only \"manual\" is implemented today (\"cloudflare\" and \"route53\" are reserved names, not working options)")
+	dnsCredentials := flag.String("dns-credentials", "", "Credentials for -dns-provider (format depends on the provider)")
 	flag.Parse()
 
+	a, err := auth.NewFromFlag(*authSpec)
+	if err != nil {
+		log.Fatalf("Invalid -auth: %v", err)
+	}
+
+	secret, err := server.LoadOrCreateSecret(*reconnectSecretPath)
+	if err != nil {
+		log.Fatalf("Reconnect secret: %v", err)
+	}
+
 	srv := server.NewTunnelServer(*domain, *tunnelDomain, *port)
+	srv.Auth = a
+	srv.ReconnectSecret = secret
+	srv.ReconnectGrace = *reconnectGrace
+
+	if *useTLS {
+		dns, err := tlsmgr.NewDNSProvider(*dnsProvider, *dnsCredentials)
+		if err != nil {
+			log.Fatalf("Invalid -dns-provider: %v", err)
+		}
+		srv.TLSManager = tlsmgr.NewManager(*domain, *tunnelDomain, *acmeEmail, *tlsCacheDir, dns, srv.RegisteredSubdomains)
+	}
+
 	if err := srv.Start(); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
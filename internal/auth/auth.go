@@ -0,0 +1,190 @@
+// Package auth authenticates clients registering a tunnel and decides
+// which subdomains they're allowed to claim.
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Credentials carries what a client presents when registering. Token is
+// carried alongside User/Pass for implementations that authenticate
+// against a bearer token instead of a password.
+type Credentials struct {
+	User  string
+	Pass  string
+	Token string
+}
+
+// Auth authenticates a client's credentials and decides which subdomains
+// the resulting user may claim.
+type Auth interface {
+	// Authenticate checks creds and returns the authenticated user name.
+	Authenticate(creds Credentials) (user string, err error)
+
+	// AllowedSubdomain reports whether user may claim subdomain.
+	AllowedSubdomain(user, subdomain string) bool
+}
+
+// None allows any client to connect and claim any subdomain. It's the
+// default when no -auth flag is given.
+type None struct{}
+
+func (None) Authenticate(Credentials) (string, error) { return "", nil }
+func (None) AllowedSubdomain(string, string) bool      { return true }
+
+// Static authenticates every client against a single fixed
+// username/password pair and places no restriction on subdomains.
+type Static struct {
+	User string
+	Pass string
+}
+
+func (s Static) Authenticate(creds Credentials) (string, error) {
+	if creds.User != s.User || creds.Pass != s.Pass {
+		return "", fmt.Errorf("auth: invalid credentials")
+	}
+	return s.User, nil
+}
+
+func (s Static) AllowedSubdomain(user, subdomain string) bool {
+	return true
+}
+
+// File authenticates against an htpasswd-style file of "user:bcryptHash"
+// lines, one per user, and restricts each user to subdomains equal to
+// their username or prefixed with "<username>-".
+type File struct {
+	users map[string]string // user -> bcrypt hash
+}
+
+// LoadFile reads a users file in "user:bcryptHash" format, one entry per
+// line. Blank lines and lines starting with "#" are ignored.
+func LoadFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: opening users file: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("auth: malformed line in users file: %q", line)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("auth: reading users file: %w", err)
+	}
+	return &File{users: users}, nil
+}
+
+func (f *File) Authenticate(creds Credentials) (string, error) {
+	hash, ok := f.users[creds.User]
+	if !ok {
+		return "", fmt.Errorf("auth: unknown user %q", creds.User)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Pass)); err != nil {
+		return "", fmt.Errorf("auth: invalid password for user %q", creds.User)
+	}
+	return creds.User, nil
+}
+
+func (f *File) AllowedSubdomain(user, subdomain string) bool {
+	return subdomain == user || strings.HasPrefix(subdomain, user+"-")
+}
+
+// TokenFile authenticates against a bearer-token file of "user:token"
+// lines, one per user, and restricts each user to subdomains equal to
+// their username or prefixed with "<username>-". Unlike File, tokens are
+// compared directly rather than hashed: they're server-issued high-entropy
+// secrets, not user-chosen passwords, so there's nothing to protect them
+// against if the file itself leaks.
+type TokenFile struct {
+	tokens map[string]string // user -> token
+}
+
+// LoadTokenFile reads a tokens file in "user:token" format, one entry per
+// line. Blank lines and lines starting with "#" are ignored.
+func LoadTokenFile(path string) (*TokenFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: opening tokens file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, token, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("auth: malformed line in tokens file: %q", line)
+		}
+		tokens[user] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("auth: reading tokens file: %w", err)
+	}
+	return &TokenFile{tokens: tokens}, nil
+}
+
+func (t *TokenFile) Authenticate(creds Credentials) (string, error) {
+	if creds.Token == "" {
+		return "", fmt.Errorf("auth: no bearer token presented")
+	}
+	for user, token := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(creds.Token)) == 1 {
+			return user, nil
+		}
+	}
+	return "", fmt.Errorf("auth: invalid bearer token")
+}
+
+func (t *TokenFile) AllowedSubdomain(user, subdomain string) bool {
+	return subdomain == user || strings.HasPrefix(subdomain, user+"-")
+}
+
+// NewFromFlag builds an Auth from the -auth flag's value: "" or "none"
+// (the default), "static:user:pass", "file:/path/to/users", or
+// "token:/path/to/tokens".
+func NewFromFlag(spec string) (Auth, error) {
+	if spec == "" || spec == "none" {
+		return None{}, nil
+	}
+
+	scheme, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("auth: malformed -auth value %q", spec)
+	}
+
+	switch scheme {
+	case "static":
+		user, pass, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("auth: -auth=static:user:pass requires both a user and a pass")
+		}
+		return Static{User: user, Pass: pass}, nil
+	case "file":
+		return LoadFile(rest)
+	case "token":
+		return LoadTokenFile(rest)
+	default:
+		return nil, fmt.Errorf("auth: unknown -auth scheme %q", scheme)
+	}
+}
@@ -1,18 +1,22 @@
 package client
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dachinat/publictunnel/internal/protocol"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -24,6 +28,10 @@ const (
 
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
+
+	// reconnectBackoff is how long Start waits before redialing after the
+	// websocket connection drops.
+	reconnectBackoff = 2 * time.Second
 )
 
 type TunnelClient struct {
@@ -32,21 +40,88 @@ type TunnelClient struct {
 	Subdomain  string
 	httpClient *http.Client
 	writeMu    sync.Mutex
+
+	// Mode is "http" (default) or "tcp". In "tcp" mode, ListenPort tells
+	// the server which port to bind for incoming connections.
+	Mode       string
+	ListenPort int
+
+	// User and Pass authenticate against a server started with
+	// -auth=static or -auth=file. Token is sent via the
+	// Sec-WebSocket-Protocol header as well as the REGISTER frame, for
+	// servers that authenticate against a bearer token instead.
+	User  string
+	Pass  string
+	Token string
+
+	// tcpStreams holds the local connections dialed for each open TCP
+	// stream, keyed by stream ID: "tcp" mode streams and, in "http" mode,
+	// upgrade passthrough streams opened by handleStreamOpen.
+	tcpStreams   map[uuid.UUID]net.Conn
+	tcpStreamsMu sync.Mutex
+
+	// reqBodies holds the pipe feeding each in-flight HTTP request's body
+	// to the local server, keyed by request ID, while its HTTP_BODY_CHUNK
+	// frames are still arriving.
+	reqBodies   map[uuid.UUID]*io.PipeWriter
+	reqBodiesMu sync.Mutex
+
+	// reconnectToken and activeSubdomain are filled in from the server's
+	// first RegisterRespPayload and let Start resume the same subdomain
+	// with a TypeReconnect message if the connection drops, instead of
+	// registering a brand new one.
+	reconnectToken  string
+	activeSubdomain string
 }
 
 func NewTunnelClient(serverURL string, localPort int, subdomain string) *TunnelClient {
+	// Configure HTTP/2 support on the transport used for the buffered
+	// request/response path, so a local gRPC (h2) server behind the
+	// client is handled natively rather than downgraded to HTTP/1.1.
+	transport := &http.Transport{}
+	http2.ConfigureTransport(transport)
+
 	return &TunnelClient{
 		ServerURL:  serverURL,
 		LocalPort:  localPort,
 		Subdomain:  subdomain,
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Transport: transport},
+		Mode:       "http",
+		tcpStreams: make(map[uuid.UUID]net.Conn),
+		reqBodies:  make(map[uuid.UUID]*io.PipeWriter),
 	}
 }
 
+// fatalError marks a connect error that retrying won't fix (e.g. rejected
+// auth or an unavailable subdomain), so Start should give up instead of
+// reconnecting.
+type fatalError struct{ err error }
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
+
+// Start dials the server and serves the tunnel, reconnecting with the
+// subdomain's reconnect token (see RegisterRespPayload.ReconnectToken)
+// whenever the connection drops, until a fatal error (bad auth, rejected
+// subdomain) gives up for good.
 func (c *TunnelClient) Start() error {
+	for {
+		err := c.connect()
+		var fe *fatalError
+		if errors.As(err, &fe) {
+			return fe.err
+		}
+		log.Printf("Disconnected: %v; reconnecting in %s...", err, reconnectBackoff)
+		time.Sleep(reconnectBackoff)
+	}
+}
+
+// connect runs a single websocket session: dial, register or reconnect,
+// then serve messages until the connection errors out.
+func (c *TunnelClient) connect() error {
 	u, err := url.Parse(c.ServerURL)
 	if err != nil {
-		return err
+		return &fatalError{err}
 	}
 
 	if u.Scheme == "http" {
@@ -56,22 +131,55 @@ func (c *TunnelClient) Start() error {
 	}
 	u.Path = "/ws"
 
+	var dialHeader http.Header
+	if c.Token != "" {
+		dialHeader = http.Header{"Sec-WebSocket-Protocol": []string{c.Token}}
+	}
+
 	log.Printf("Connecting to %s...", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), dialHeader)
 	if err != nil {
 		return fmt.Errorf("dial: %v", err)
 	}
 	defer conn.Close()
+	defer c.closeAllStreams()
 
-	// Register
-	reg := protocol.ControlMessage{
-		Type: protocol.TypeRegister,
-		Payload: protocol.RegisterPayload{
-			Subdomain: c.Subdomain,
-		},
+	mode := c.Mode
+	if mode == "" {
+		mode = "http"
 	}
-	if err := conn.WriteJSON(reg); err != nil {
-		return fmt.Errorf("register: %v", err)
+
+	reconnecting := c.activeSubdomain != "" && c.reconnectToken != ""
+	registered := false
+
+	if reconnecting {
+		rec := protocol.ControlMessage{
+			Type: protocol.TypeReconnect,
+			Payload: protocol.ReconnectPayload{
+				Subdomain: c.activeSubdomain,
+				Token:     c.reconnectToken,
+			},
+		}
+		if err := conn.WriteJSON(rec); err != nil {
+			return fmt.Errorf("reconnect: %v", err)
+		}
+	} else {
+		var authPayload *protocol.AuthPayload
+		if c.User != "" || c.Pass != "" || c.Token != "" {
+			authPayload = &protocol.AuthPayload{User: c.User, Pass: c.Pass, Token: c.Token}
+		}
+		reg := protocol.ControlMessage{
+			Type: protocol.TypeRegister,
+			Payload: protocol.RegisterPayload{
+				Subdomain:  c.Subdomain,
+				Mode:       mode,
+				ListenPort: c.ListenPort,
+				Auth:       authPayload,
+			},
+		}
+		if err := conn.WriteJSON(reg); err != nil {
+			return fmt.Errorf("register: %v", err)
+		}
 	}
 
 	// Set up health checks
@@ -85,11 +193,16 @@ func (c *TunnelClient) Start() error {
 	})
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		msgType, msg, err := conn.ReadMessage()
 		if err != nil {
 			return fmt.Errorf("read: %v", err)
 		}
 
+		if msgType == websocket.BinaryMessage {
+			c.handleBinaryFrame(msg)
+			continue
+		}
+
 		var ctrl protocol.ControlMessage
 		if err := json.Unmarshal(msg, &ctrl); err != nil {
 			log.Printf("Unmarshal error: %v", err)
@@ -102,34 +215,75 @@ func (c *TunnelClient) Start() error {
 			var resp protocol.RegisterRespPayload
 			json.Unmarshal(data, &resp)
 			if resp.Error != "" {
-				return fmt.Errorf("registration failed: %s", resp.Error)
+				return &fatalError{fmt.Errorf("registration failed: %s", resp.Error)}
 			}
+			registered = true
+			c.activeSubdomain = resp.Subdomain
+			c.reconnectToken = resp.ReconnectToken
 			log.Printf("Tunnel established!")
-			log.Printf("Public URL: %s", resp.URL)
-			log.Printf("Forwarding to: http://localhost:%d", c.LocalPort)
+			if mode == "tcp" {
+				log.Printf("Public TCP port: %d", c.ListenPort)
+			} else {
+				log.Printf("Public URL: %s", resp.URL)
+			}
+			log.Printf("Forwarding to: localhost:%d", c.LocalPort)
 
 		case protocol.TypeHttpRequest:
 			data, _ := json.Marshal(ctrl.Payload)
 			var reqPayload protocol.HttpRequestPayload
 			json.Unmarshal(data, &reqPayload)
-			go c.handleRequest(conn, reqPayload)
+			if reqID, err := uuid.Parse(reqPayload.ID); err == nil {
+				pr, pw := io.Pipe()
+				c.reqBodiesMu.Lock()
+				c.reqBodies[reqID] = pw
+				c.reqBodiesMu.Unlock()
+				go c.handleRequest(conn, reqPayload, reqID, pr)
+			}
+
+		case protocol.TypeTCPOpen:
+			data, _ := json.Marshal(ctrl.Payload)
+			var openPayload protocol.TCPOpenPayload
+			json.Unmarshal(data, &openPayload)
+			go c.handleTCPOpen(conn, openPayload)
+
+		case protocol.TypeStreamOpen:
+			data, _ := json.Marshal(ctrl.Payload)
+			var openPayload protocol.StreamOpenPayload
+			json.Unmarshal(data, &openPayload)
+			go c.handleStreamOpen(conn, openPayload)
+
+		case protocol.TypeTCPClose:
+			data, _ := json.Marshal(ctrl.Payload)
+			var closePayload protocol.TCPClosePayload
+			json.Unmarshal(data, &closePayload)
+			c.closeTCPStream(closePayload.StreamID)
 
 		case protocol.TypeError:
 			data, _ := json.Marshal(ctrl.Payload)
 			var errPayload protocol.ErrorPayload
 			json.Unmarshal(data, &errPayload)
+			if !registered && !reconnecting {
+				// The server rejects a REGISTER (bad credentials, a
+				// subdomain the user may not claim) with an ERROR before
+				// any REGISTER_RESP.
+				return &fatalError{fmt.Errorf("registration rejected: %s", errPayload.Message)}
+			}
 			log.Printf("Server error: %s", errPayload.Message)
 		}
 	}
 }
 
-func (c *TunnelClient) handleRequest(conn *websocket.Conn, req protocol.HttpRequestPayload) {
+// handleRequest proxies req to the local server, streaming its body in
+// from pr (fed by HTTP_BODY_CHUNK frames routed through handleBinaryFrame)
+// and streaming the response back out the same way.
+func (c *TunnelClient) handleRequest(conn *websocket.Conn, req protocol.HttpRequestPayload, reqID uuid.UUID, pr *io.PipeReader) {
 	localURL := fmt.Sprintf("http://localhost:%d%s", c.LocalPort, req.Path)
 	log.Printf("Proxying: %s %s -> %s", req.Method, req.Path, localURL)
 
-	httpReq, err := http.NewRequest(req.Method, localURL, bytes.NewReader(req.Body))
+	httpReq, err := http.NewRequest(req.Method, localURL, pr)
 	if err != nil {
 		log.Printf("Failed to create request: %v", err)
+		c.dropRequestBody(reqID)
 		return
 	}
 
@@ -140,27 +294,233 @@ func (c *TunnelClient) handleRequest(conn *websocket.Conn, req protocol.HttpRequ
 	}
 
 	resp, err := c.httpClient.Do(httpReq)
-	var respPayload protocol.HttpResponsePayload
-	respPayload.ID = req.ID
+	c.dropRequestBody(reqID)
 
 	if err != nil {
 		log.Printf("Local request failed: %v", err)
-		respPayload.Status = http.StatusBadGateway
-		respPayload.Body = []byte(fmt.Sprintf("Local request failed: %v", err))
-	} else {
-		defer resp.Body.Close()
-		body, _ := io.ReadAll(resp.Body)
-		respPayload.Status = resp.StatusCode
-		respPayload.Headers = resp.Header
-		respPayload.Body = body
+		c.sendResponse(conn, protocol.ControlMessage{
+			Type: protocol.TypeHttpResponse,
+			Payload: protocol.HttpResponsePayload{
+				ID:     req.ID,
+				Status: http.StatusBadGateway,
+			},
+		})
+		c.sendBinary(conn, protocol.EncodeFrame(protocol.FrameHTTPBodyChunk, reqID, []byte(fmt.Sprintf("Local request failed: %v", err))))
+		c.sendBinary(conn, protocol.EncodeFrame(protocol.FrameHTTPBodyEnd, reqID, nil))
+		return
 	}
+	defer resp.Body.Close()
 
-	ctrlMsg := protocol.ControlMessage{
-		Type:    protocol.TypeHttpResponse,
-		Payload: respPayload,
+	c.sendResponse(conn, protocol.ControlMessage{
+		Type: protocol.TypeHttpResponse,
+		Payload: protocol.HttpResponsePayload{
+			ID:      req.ID,
+			Status:  resp.StatusCode,
+			Headers: resp.Header,
+		},
+	})
+
+	streamBody(resp.Body, func(chunk []byte) {
+		c.sendBinary(conn, protocol.EncodeFrame(protocol.FrameHTTPBodyChunk, reqID, chunk))
+	})
+	c.sendBinary(conn, protocol.EncodeFrame(protocol.FrameHTTPBodyEnd, reqID, nil))
+}
+
+// dropRequestBody removes reqID's pipe writer and closes it, unblocking
+// any writes handleBinaryFrame is still making into a request whose local
+// round trip has already finished or failed.
+func (c *TunnelClient) dropRequestBody(reqID uuid.UUID) {
+	c.reqBodiesMu.Lock()
+	pw, ok := c.reqBodies[reqID]
+	delete(c.reqBodies, reqID)
+	c.reqBodiesMu.Unlock()
+	if ok {
+		pw.Close()
+	}
+}
+
+// streamBody reads r in fixed-size chunks, calling send for each one,
+// until EOF or an error.
+func streamBody(r io.Reader, send func([]byte)) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			send(buf[:n])
+		}
+		if err != nil {
+			return
+		}
 	}
+}
 
-	c.sendResponse(conn, ctrlMsg)
+// handleTCPOpen dials the local service for a newly announced TCP stream
+// and pumps its responses back to the server as TCP_DATA frames until the
+// connection closes.
+func (c *TunnelClient) handleTCPOpen(conn *websocket.Conn, open protocol.TCPOpenPayload) {
+	streamID, err := uuid.Parse(open.StreamID)
+	if err != nil {
+		return
+	}
+
+	local, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", c.LocalPort))
+	if err != nil {
+		log.Printf("Failed to dial local port %d for stream %s: %v", c.LocalPort, open.StreamID, err)
+		c.sendTCPClose(conn, streamID)
+		return
+	}
+
+	c.tcpStreamsMu.Lock()
+	c.tcpStreams[streamID] = local
+	c.tcpStreamsMu.Unlock()
+
+	c.pumpLocalStream(conn, streamID, local)
+}
+
+// handleStreamOpen dials the local server for a passthrough stream (a
+// WebSocket or h2c upgrade the server hijacked rather than buffered),
+// replays the original request line and headers, then pumps bytes in both
+// directions the same way handleTCPOpen does.
+func (c *TunnelClient) handleStreamOpen(conn *websocket.Conn, open protocol.StreamOpenPayload) {
+	streamID, err := uuid.Parse(open.StreamID)
+	if err != nil {
+		return
+	}
+
+	local, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", c.LocalPort))
+	if err != nil {
+		log.Printf("Failed to dial local port %d for stream %s: %v", c.LocalPort, open.StreamID, err)
+		c.sendTCPClose(conn, streamID)
+		return
+	}
+
+	c.tcpStreamsMu.Lock()
+	c.tcpStreams[streamID] = local
+	c.tcpStreamsMu.Unlock()
+
+	var reqLine strings.Builder
+	fmt.Fprintf(&reqLine, "%s %s HTTP/1.1\r\n", open.Method, open.Path)
+	if open.Host != "" {
+		fmt.Fprintf(&reqLine, "Host: %s\r\n", open.Host)
+	}
+	for k, vv := range open.Headers {
+		for _, v := range vv {
+			fmt.Fprintf(&reqLine, "%s: %s\r\n", k, v)
+		}
+	}
+	reqLine.WriteString("\r\n")
+	if _, err := local.Write([]byte(reqLine.String())); err != nil {
+		log.Printf("Failed to replay upgrade request to local port %d: %v", c.LocalPort, err)
+	}
+
+	c.pumpLocalStream(conn, streamID, local)
+}
+
+// pumpLocalStream streams local's output back to the server as TCP_DATA
+// frames until it closes or errors, then tears down the stream. Shared by
+// handleTCPOpen and handleStreamOpen, which differ only in what they send
+// to local before pumping starts.
+func (c *TunnelClient) pumpLocalStream(conn *websocket.Conn, streamID uuid.UUID, local net.Conn) {
+	streamBody(local, func(chunk []byte) {
+		c.sendBinary(conn, protocol.EncodeFrame(protocol.FrameTCPData, streamID, chunk))
+	})
+
+	c.sendTCPClose(conn, streamID)
+	local.Close()
+	c.tcpStreamsMu.Lock()
+	delete(c.tcpStreams, streamID)
+	c.tcpStreamsMu.Unlock()
+}
+
+// handleBinaryFrame decodes a binary frame from the server and routes it
+// to the matching TCP stream or HTTP request body, based on its type.
+func (c *TunnelClient) handleBinaryFrame(msg []byte) {
+	ft, id, data, err := protocol.DecodeFrame(msg)
+	if err != nil {
+		return
+	}
+
+	switch ft {
+	case protocol.FrameTCPData:
+		c.tcpStreamsMu.Lock()
+		local, ok := c.tcpStreams[uuid.UUID(id)]
+		c.tcpStreamsMu.Unlock()
+		if ok {
+			local.Write(data)
+		}
+
+	case protocol.FrameHTTPBodyChunk:
+		c.reqBodiesMu.Lock()
+		pw, ok := c.reqBodies[uuid.UUID(id)]
+		c.reqBodiesMu.Unlock()
+		if ok {
+			pw.Write(data)
+		}
+
+	case protocol.FrameHTTPBodyEnd:
+		c.reqBodiesMu.Lock()
+		pw, ok := c.reqBodies[uuid.UUID(id)]
+		delete(c.reqBodies, uuid.UUID(id))
+		c.reqBodiesMu.Unlock()
+		if ok {
+			pw.Close()
+		}
+	}
+}
+
+func (c *TunnelClient) closeTCPStream(rawStreamID string) {
+	streamID, err := uuid.Parse(rawStreamID)
+	if err != nil {
+		return
+	}
+	c.tcpStreamsMu.Lock()
+	local, ok := c.tcpStreams[streamID]
+	delete(c.tcpStreams, streamID)
+	c.tcpStreamsMu.Unlock()
+	if ok {
+		local.Close()
+	}
+}
+
+// closeAllStreams tears down every in-flight request body and TCP/upgrade
+// stream left over from the websocket session that just ended. Without
+// this, a request whose body hadn't finished streaming (its handleRequest
+// goroutine blocked in c.httpClient.Do, reading a pipe nobody will ever
+// write to or close again) or an open stream leaks its goroutine and local
+// net.Conn on every reconnect cycle, since connect starts with fresh,
+// empty maps rather than reusing these.
+func (c *TunnelClient) closeAllStreams() {
+	c.reqBodiesMu.Lock()
+	reqBodies := c.reqBodies
+	c.reqBodies = make(map[uuid.UUID]*io.PipeWriter)
+	c.reqBodiesMu.Unlock()
+	for _, pw := range reqBodies {
+		pw.Close()
+	}
+
+	c.tcpStreamsMu.Lock()
+	tcpStreams := c.tcpStreams
+	c.tcpStreams = make(map[uuid.UUID]net.Conn)
+	c.tcpStreamsMu.Unlock()
+	for _, conn := range tcpStreams {
+		conn.Close()
+	}
+}
+
+func (c *TunnelClient) sendTCPClose(conn *websocket.Conn, streamID uuid.UUID) {
+	c.sendResponse(conn, protocol.ControlMessage{
+		Type:    protocol.TypeTCPClose,
+		Payload: protocol.TCPClosePayload{StreamID: streamID.String()},
+	})
+}
+
+func (c *TunnelClient) sendBinary(conn *websocket.Conn, b []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		log.Printf("Failed to send binary frame: %v", err)
+	}
 }
 
 func (c *TunnelClient) sendResponse(conn *websocket.Conn, msg protocol.ControlMessage) {
@@ -1,5 +1,7 @@
 package protocol
 
+import "fmt"
+
 type MessageType string
 
 const (
@@ -8,6 +10,23 @@ const (
 	TypeHttpRequest  MessageType = "HTTP_REQUEST"
 	TypeHttpResponse MessageType = "HTTP_RESPONSE"
 	TypeError        MessageType = "ERROR"
+
+	// TypeTCPOpen announces a new TCP stream and the target port it was
+	// accepted on. The stream's data follows as binary FrameTCPData frames
+	// and a TypeTCPClose message ends it, both carrying the same stream ID.
+	TypeTCPOpen  MessageType = "TCP_OPEN"
+	TypeTCPData  MessageType = "TCP_DATA"
+	TypeTCPClose MessageType = "TCP_CLOSE"
+
+	// TypeReconnect resumes a tunnel after a dropped websocket connection,
+	// in place of TypeRegister.
+	TypeReconnect MessageType = "RECONNECT"
+
+	// TypeStreamOpen announces a raw byte-stream passthrough for a request
+	// that asked to upgrade (WebSocket, h2c), in place of TypeHttpRequest.
+	// Its data flows as FrameTCPData frames and it closes like a TCP
+	// stream, reusing the same framing as TypeTCPOpen.
+	TypeStreamOpen MessageType = "STREAM_OPEN"
 )
 
 type ControlMessage struct {
@@ -17,29 +36,140 @@ type ControlMessage struct {
 
 type RegisterPayload struct {
 	Subdomain string `json:"subdomain"`
+
+	// Mode selects how the tunnel routes traffic: "http" (the default,
+	// routing by subdomain) or "tcp" (raw byte streams on ListenPort).
+	Mode string `json:"mode,omitempty"`
+
+	// ListenPort is the server-side port TunnelServer should bind for a
+	// "tcp" mode tunnel. Ignored in "http" mode.
+	ListenPort int `json:"listenPort,omitempty"`
+
+	// Auth carries credentials for servers started with a non-"none"
+	// -auth mode. A client may instead (or also) present a bearer token in
+	// the Sec-WebSocket-Protocol header of the upgrade request; the server
+	// reads that header only when Auth carries no token.
+	Auth *AuthPayload `json:"auth,omitempty"`
+}
+
+// AuthPayload carries credentials presented at registration time.
+type AuthPayload struct {
+	User  string `json:"user,omitempty"`
+	Pass  string `json:"pass,omitempty"`
+	Token string `json:"token,omitempty"`
 }
 
 type RegisterRespPayload struct {
 	Subdomain string `json:"subdomain"`
 	URL       string `json:"url"`
 	Error     string `json:"error,omitempty"`
+
+	// ReconnectToken lets the client resume this subdomain with a
+	// TypeReconnect message if the websocket connection drops. It is
+	// reissued (with a fresh expiry) on every successful register or
+	// reconnect.
+	ReconnectToken string `json:"reconnectToken,omitempty"`
 }
 
+// ReconnectPayload resumes a tunnel after a dropped websocket connection,
+// reattaching to the subdomain Token was issued for.
+type ReconnectPayload struct {
+	Subdomain string `json:"subdomain"`
+	Token     string `json:"token"`
+}
+
+// HttpRequestPayload is the header frame for a tunneled HTTP request. The
+// body, if any, follows as one or more FrameHTTPBodyChunk frames and a
+// closing FrameHTTPBodyEnd frame, all keyed by ID.
 type HttpRequestPayload struct {
 	ID      string              `json:"id"`
 	Method  string              `json:"method"`
 	Path    string              `json:"path"`
 	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
 }
 
+// HttpResponsePayload is the header frame for a tunneled HTTP response.
+// The body, if any, follows the same way as HttpRequestPayload's.
 type HttpResponsePayload struct {
 	ID      string              `json:"id"`
 	Status  int                 `json:"status"`
 	Headers map[string][]string `json:"headers"`
-	Body    []byte              `json:"body"`
 }
 
 type ErrorPayload struct {
 	Message string `json:"message"`
 }
+
+// TCPOpenPayload announces a new TCP stream. StreamID identifies the
+// stream in the TCP_DATA/TCP_CLOSE frames that follow it, and Port is the
+// server-side listen port the connection arrived on.
+type TCPOpenPayload struct {
+	StreamID string `json:"streamId"`
+	Port     int    `json:"port"`
+}
+
+// TCPClosePayload marks the end of a TCP stream, in either direction. It
+// also closes a TypeStreamOpen passthrough stream.
+type TCPClosePayload struct {
+	StreamID string `json:"streamId"`
+}
+
+// StreamOpenPayload announces a raw byte-stream passthrough for a tunneled
+// request that asked to upgrade its connection (e.g. a WebSocket or h2c
+// handshake). StreamID identifies the stream in the TCP_DATA/TCP_CLOSE
+// frames that follow it, same as TCPOpenPayload; Method, Path, Host and
+// Headers are the original request line and headers, replayed by the
+// client against its local server before bytes start flowing. Host is
+// carried separately from Headers because net/http splits it out of
+// r.Header into r.Host.
+type StreamOpenPayload struct {
+	StreamID string              `json:"streamId"`
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	Host     string              `json:"host"`
+	Headers  map[string][]string `json:"headers"`
+}
+
+// FrameType identifies the kind of binary websocket frame produced by
+// EncodeFrame. Unlike the JSON-carried ControlMessage types above, these
+// are used on the data path, where base64-in-JSON overhead isn't
+// acceptable.
+type FrameType byte
+
+const (
+	// FrameTCPData carries a raw chunk of a TCP_DATA stream.
+	FrameTCPData FrameType = 1
+
+	// FrameHTTPBodyChunk carries a chunk of an HTTP request or response
+	// body, keyed by the same ID as the HttpRequestPayload/
+	// HttpResponsePayload header frame it belongs to.
+	FrameHTTPBodyChunk FrameType = 2
+
+	// FrameHTTPBodyEnd marks the end of an HTTP body; its data is empty.
+	FrameHTTPBodyEnd FrameType = 3
+)
+
+// frameHeaderSize is the fixed header preceding the payload in a frame
+// produced by EncodeFrame: 1 type byte + a 16-byte stream ID.
+const frameHeaderSize = 1 + 16
+
+// EncodeFrame packs a stream ID and a chunk of data into a single binary
+// websocket message: [1 byte type][16 byte stream ID][payload].
+func EncodeFrame(ft FrameType, streamID [16]byte, data []byte) []byte {
+	buf := make([]byte, frameHeaderSize+len(data))
+	buf[0] = byte(ft)
+	copy(buf[1:frameHeaderSize], streamID[:])
+	copy(buf[frameHeaderSize:], data)
+	return buf
+}
+
+// DecodeFrame parses a binary websocket message produced by EncodeFrame.
+func DecodeFrame(b []byte) (ft FrameType, streamID [16]byte, data []byte, err error) {
+	if len(b) < frameHeaderSize {
+		return 0, streamID, nil, fmt.Errorf("protocol: frame too short (%d bytes)", len(b))
+	}
+	ft = FrameType(b[0])
+	copy(streamID[:], b[1:frameHeaderSize])
+	data = b[frameHeaderSize:]
+	return ft, streamID, data, nil
+}
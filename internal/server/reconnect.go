@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconnectTokenTTL bounds how long a reconnect token stays valid. It's
+// deliberately longer than the in-memory orphan grace period (which is
+// what actually gates whether a slot is still around to reattach to) so
+// that restarting the server secret file doesn't need to line up with it.
+const reconnectTokenTTL = 24 * time.Hour
+
+// mintReconnectToken signs a fresh token for subdomain using s.ReconnectSecret.
+func (s *TunnelServer) mintReconnectToken(subdomain string) string {
+	expiry := time.Now().Add(reconnectTokenTTL).Unix()
+	return signReconnectToken(s.ReconnectSecret, subdomain, expiry)
+}
+
+// verifyReconnectToken reports whether token is a live, unexpired token
+// for subdomain.
+func (s *TunnelServer) verifyReconnectToken(subdomain, token string) bool {
+	// expiry and the base64-encoded MAC never contain a ".", so
+	// SplitN's third part safely captures the rest of the token as-is
+	// even when subdomain itself contains one (e.g. "alice.dev").
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	expiryStr, _, tokSubdomain := parts[0], parts[1], parts[2]
+	if tokSubdomain != subdomain {
+		return false
+	}
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	if time.Now().Unix() > expiry {
+		return false
+	}
+	expected := signReconnectToken(s.ReconnectSecret, subdomain, expiry)
+	return hmac.Equal([]byte(expected), []byte(token))
+}
+
+// signReconnectToken formats a token as "<expiry>.<mac>.<subdomain>",
+// putting the variable-length, arbitrary-content subdomain last so
+// splitting on "." with a cap can't truncate it.
+func signReconnectToken(secret []byte, subdomain string, expiry int64) string {
+	payload := fmt.Sprintf("%d.%s", expiry, subdomain)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return fmt.Sprintf("%d.%s.%s", expiry, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), subdomain)
+}
+
+// LoadOrCreateSecret reads a base64-encoded secret from path, generating
+// and persisting a new random 32-byte one if the file doesn't exist yet.
+// Reusing the same secret across restarts keeps previously issued
+// reconnect tokens valid.
+func LoadOrCreateSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		secret, decodeErr := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if decodeErr != nil {
+			return nil, fmt.Errorf("reconnect secret: decoding %s: %w", path, decodeErr)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reconnect secret: reading %s: %w", path, err)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("reconnect secret: generating: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(secret)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("reconnect secret: writing %s: %w", path, err)
+	}
+	return secret, nil
+}
@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/dachi-pa/publictunnel/internal/protocol"
+	"github.com/dachinat/publictunnel/internal/auth"
+	"github.com/dachinat/publictunnel/internal/protocol"
+	"github.com/dachinat/publictunnel/internal/tlsmgr"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -37,6 +40,39 @@ var upgrader = websocket.Upgrader{
 type ClientConn struct {
 	conn *websocket.Conn
 	mu   sync.Mutex
+
+	// mode is "http" (default) or "tcp".
+	mode string
+
+	// streams holds the downstream connections piped to this client,
+	// keyed by stream ID: connections accepted on its listen port in
+	// "tcp" mode, and hijacked upgrade connections from proxyUpgrade.
+	streams   map[uuid.UUID]*tcpStream
+	streamsMu sync.Mutex
+
+	// orphaned is set while conn has dropped but the subdomain's grace
+	// period hasn't yet lapsed; proxyToClient waits on the gate instead of
+	// failing immediately. gate is replaced each time the client goes
+	// orphaned and is signaled exactly once, either by a successful
+	// reattach or by the grace period expiring.
+	orphaned    bool
+	gate        *reconnectGate
+	reconnectMu sync.Mutex
+}
+
+// reconnectGate is a channel that's closed exactly once (via sync.Once, so
+// a racing reattach and grace-period expiry can't double-close it).
+type reconnectGate struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newReconnectGate() *reconnectGate {
+	return &reconnectGate{ch: make(chan struct{})}
+}
+
+func (g *reconnectGate) signal() {
+	g.once.Do(func() { close(g.ch) })
 }
 
 func (c *ClientConn) WriteJSON(v interface{}) error {
@@ -46,14 +82,272 @@ func (c *ClientConn) WriteJSON(v interface{}) error {
 	return c.conn.WriteJSON(v)
 }
 
+func (c *ClientConn) WriteBinary(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// markOrphaned flags the client as disconnected-but-in-grace and returns
+// the gate that will fire when it either reattaches or the grace period
+// runs out.
+func (c *ClientConn) markOrphaned() *reconnectGate {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	c.orphaned = true
+	c.gate = newReconnectGate()
+	return c.gate
+}
+
+// reattach swaps in a newly reconnected websocket and wakes anything
+// waiting on the orphan gate.
+func (c *ClientConn) reattach(conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	c.reconnectMu.Lock()
+	c.orphaned = false
+	gate := c.gate
+	c.reconnectMu.Unlock()
+	if gate != nil {
+		gate.signal()
+	}
+}
+
+// expire wakes anything waiting on the orphan gate without clearing
+// orphaned, for when the grace period lapses with no reconnect.
+func (c *ClientConn) expire() {
+	c.reconnectMu.Lock()
+	gate := c.gate
+	c.reconnectMu.Unlock()
+	if gate != nil {
+		gate.signal()
+	}
+}
+
+// orphanState reports whether the client is currently orphaned and, if
+// so, the gate that will signal when that changes.
+func (c *ClientConn) orphanState() (orphaned bool, gate *reconnectGate) {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	return c.orphaned, c.gate
+}
+
+func (c *ClientConn) addStream(id uuid.UUID, conn net.Conn) {
+	c.streamsMu.Lock()
+	c.streams[id] = newTCPStream(conn)
+	c.streamsMu.Unlock()
+}
+
+func (c *ClientConn) stream(id uuid.UUID) (*tcpStream, bool) {
+	c.streamsMu.Lock()
+	stream, ok := c.streams[id]
+	c.streamsMu.Unlock()
+	return stream, ok
+}
+
+func (c *ClientConn) removeStream(id uuid.UUID) {
+	c.streamsMu.Lock()
+	stream, ok := c.streams[id]
+	delete(c.streams, id)
+	c.streamsMu.Unlock()
+	if ok {
+		stream.queue.shutdown()
+	}
+}
+
+// frameQueueSize bounds how many inbound frames a single stream or HTTP
+// response body can have queued waiting on a slow downstream before
+// frameQueue.enqueue starts blocking its caller.
+const frameQueueSize = 64
+
+// tcpStream pairs a downstream TCP connection (an accepted "tcp" mode
+// listener connection or a hijacked upgrade connection) with a frameQueue that serializes writes to it off the
+// shared websocket read loop.
+type tcpStream struct {
+	conn  net.Conn
+	queue *frameQueue
+}
+
+func newTCPStream(conn net.Conn) *tcpStream {
+	s := &tcpStream{conn: conn}
+	s.queue = newFrameQueue(frameQueueSize, func(data []byte) {
+		conn.Write(data)
+	}, nil)
+	return s
+}
+
+// frameQueue decouples receiving a binary frame on a client's shared
+// websocket read loop from delivering it to a (possibly slow) downstream
+// consumer: enqueue only blocks once size frames are backed up, instead of
+// every frame waiting on deliver to return. Without this, a single slow
+// TCP peer or HTTP client would stall every other request/stream
+// multiplexed on the same tunnel, including the pings that keep the
+// tunnel itself from being mistaken for dead.
+type frameQueue struct {
+	queue chan []byte
+	once  sync.Once
+}
+
+// newFrameQueue starts the delivery goroutine and returns the queue to
+// enqueue onto. onDone, if non-nil, runs once shutdown has been called and
+// every frame enqueued before it has been delivered, in order.
+func newFrameQueue(size int, deliver func([]byte), onDone func()) *frameQueue {
+	fq := &frameQueue{queue: make(chan []byte, size)}
+	go func() {
+		for data := range fq.queue {
+			deliver(data)
+		}
+		if onDone != nil {
+			onDone()
+		}
+	}()
+	return fq
+}
+
+func (fq *frameQueue) enqueue(data []byte) {
+	fq.queue <- data
+}
+
+// shutdown stops the delivery goroutine once it's drained anything already
+// queued. Safe to call more than once.
+func (fq *frameQueue) shutdown() {
+	fq.once.Do(func() { close(fq.queue) })
+}
+
+// pendingResponse tracks an in-flight request waiting on a response from
+// the client: its header frame, then a stream of body chunks terminated
+// by closing the channel.
+//
+// It also keeps enough of the original request around (subdomain, the
+// HttpRequestPayload, and the body as it was streamed out) to replay it to
+// a freshly reattached ClientConn: a request can be sitting here, already
+// sent once, when the client's websocket drops and reconnects within its
+// grace period, and the client has nothing buffered to resend on its own.
+type pendingResponse struct {
+	header chan *protocol.HttpResponsePayload
+	chunks chan []byte
+
+	// bodyQueue delivers FrameHTTPBodyChunk/FrameHTTPBodyEnd frames into
+	// chunks off the client's shared websocket read loop, so a response
+	// body the consuming http.ResponseWriter is slow to drain can't stall
+	// frames for other requests or streams multiplexed on the same tunnel.
+	bodyQueue *frameQueue
+
+	subdomain    string
+	req          protocol.HttpRequestPayload
+	bodyChunks   [][]byte
+	bodyChunksMu sync.Mutex
+
+	// responded is set once a TypeHttpResponse header has been received
+	// for this request. A response having arrived means the client already
+	// ran it against its local backend, so resendPending must not replay
+	// it again on reconnect: for a non-idempotent request (e.g. POST), a
+	// second run would duplicate whatever side effect the first one had.
+	responded   bool
+	respondedMu sync.Mutex
+}
+
+// markResponded records that a response header has arrived for p.
+func (p *pendingResponse) markResponded() {
+	p.respondedMu.Lock()
+	p.responded = true
+	p.respondedMu.Unlock()
+}
+
+// hasResponded reports whether a response header has arrived for p.
+func (p *pendingResponse) hasResponded() bool {
+	p.respondedMu.Lock()
+	defer p.respondedMu.Unlock()
+	return p.responded
+}
+
+// newPendingResponse builds a pendingResponse for subdomain/req, with its
+// bodyQueue wired to deliver into chunks and close it once the queue is
+// shut down (by an arriving FrameHTTPBodyEnd) and fully drained.
+func newPendingResponse(subdomain string, req protocol.HttpRequestPayload) *pendingResponse {
+	p := &pendingResponse{
+		header:    make(chan *protocol.HttpResponsePayload, 1),
+		chunks:    make(chan []byte, frameQueueSize),
+		subdomain: subdomain,
+		req:       req,
+	}
+	p.bodyQueue = newFrameQueue(frameQueueSize, func(data []byte) {
+		p.chunks <- data
+	}, func() {
+		close(p.chunks)
+	})
+	return p
+}
+
+// recordBodyChunk appends chunk to the cached body so it can be replayed on
+// reconnect. Safe to call concurrently with resend: bodyChunksMu guards
+// bodyChunks, and resend replays the chunks recorded up to the moment it
+// takes the lock.
+func (p *pendingResponse) recordBodyChunk(chunk []byte) {
+	p.bodyChunksMu.Lock()
+	p.bodyChunks = append(p.bodyChunks, append([]byte(nil), chunk...))
+	p.bodyChunksMu.Unlock()
+}
+
+// resend replays the cached request and body to client, for when its
+// websocket has just reattached after an orphan/reconnect cycle.
+func (p *pendingResponse) resend(client *ClientConn) error {
+	reqID, err := uuid.Parse(p.req.ID)
+	if err != nil {
+		return err
+	}
+	if err := client.WriteJSON(protocol.ControlMessage{
+		Type:    protocol.TypeHttpRequest,
+		Payload: p.req,
+	}); err != nil {
+		return err
+	}
+	p.bodyChunksMu.Lock()
+	chunks := p.bodyChunks
+	p.bodyChunksMu.Unlock()
+	for _, chunk := range chunks {
+		if err := client.WriteBinary(protocol.EncodeFrame(protocol.FrameHTTPBodyChunk, reqID, chunk)); err != nil {
+			return err
+		}
+	}
+	return client.WriteBinary(protocol.EncodeFrame(protocol.FrameHTTPBodyEnd, reqID, nil))
+}
+
+// defaultReconnectGrace is how long an orphaned client's subdomain slot is
+// held open, and incoming requests to it queued, waiting for a reconnect.
+const defaultReconnectGrace = 30 * time.Second
+
 type TunnelServer struct {
 	Domain       string
 	TunnelDomain string
 	Port         int
-	clients      map[string]*ClientConn
-	clientsMu    sync.RWMutex
-	pendingReqs  map[string]chan *protocol.HttpResponsePayload
-	reqsMu       sync.RWMutex
+	Auth         auth.Auth
+
+	// ReconnectSecret signs reconnect tokens; set it (e.g. via
+	// LoadOrCreateSecret) before Start so restarts don't invalidate
+	// outstanding tokens.
+	ReconnectSecret []byte
+
+	// ReconnectGrace overrides defaultReconnectGrace when positive.
+	ReconnectGrace time.Duration
+
+	// TLSManager, when set, switches Start to terminate TLS on :443 (with
+	// a :80 HTTP->HTTPS redirect) using its wildcard certificate instead
+	// of serving plain HTTP on Port.
+	TLSManager *tlsmgr.Manager
+
+	clients     map[string]*ClientConn
+	clientsMu   sync.RWMutex
+	pendingReqs map[string]*pendingResponse
+	reqsMu      sync.RWMutex
+
+	// tcpListeners holds the net.Listener bound for each "tcp" mode
+	// client, keyed by subdomain, so it can be torn down on disconnect.
+	tcpListeners   map[string]net.Listener
+	tcpListenersMu sync.Mutex
 }
 
 func NewTunnelServer(domain string, tunnelDomain string, port int) *TunnelServer {
@@ -64,19 +358,66 @@ func NewTunnelServer(domain string, tunnelDomain string, port int) *TunnelServer
 		Domain:       domain,
 		TunnelDomain: tunnelDomain,
 		Port:         port,
+		Auth:         auth.None{},
 		clients:      make(map[string]*ClientConn),
-		pendingReqs:  make(map[string]chan *protocol.HttpResponsePayload),
+		pendingReqs:  make(map[string]*pendingResponse),
+		tcpListeners: make(map[string]net.Listener),
 	}
 }
 
-func (s *TunnelServer) Start() error {
-	addr := fmt.Sprintf(":%d", s.Port)
-	log.Printf("Server starting on %s", addr)
+func (s *TunnelServer) reconnectGrace() time.Duration {
+	if s.ReconnectGrace > 0 {
+		return s.ReconnectGrace
+	}
+	return defaultReconnectGrace
+}
+
+// RegisteredSubdomains lists the subdomains currently claimed by a
+// client, including one orphaned within its reconnect grace period. It's
+// passed to tlsmgr.NewManager so the Manager serves the wildcard
+// certificate only for hosts of live tunnels.
+func (s *TunnelServer) RegisteredSubdomains() []string {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	subdomains := make([]string, 0, len(s.clients))
+	for subdomain := range s.clients {
+		subdomains = append(subdomains, subdomain)
+	}
+	return subdomains
+}
 
+func (s *TunnelServer) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRequest)
 
-	return http.ListenAndServe(addr, mux)
+	if s.TLSManager == nil {
+		addr := fmt.Sprintf(":%d", s.Port)
+		log.Printf("Server starting on %s", addr)
+		return http.ListenAndServe(addr, mux)
+	}
+
+	go func() {
+		log.Printf("Redirecting HTTP on :80 to HTTPS")
+		if err := http.ListenAndServe(":80", http.HandlerFunc(redirectToHTTPS)); err != nil {
+			log.Printf("HTTP->HTTPS redirect server failed: %v", err)
+		}
+	}()
+
+	log.Printf("Server starting on :443 (TLS)")
+	httpsServer := &http.Server{
+		Addr:      ":443",
+		Handler:   mux,
+		TLSConfig: s.TLSManager.TLSConfig(),
+	}
+	return httpsServer.ListenAndServeTLS("", "")
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if idx := strings.Index(host, ":"); idx != -1 {
+		host = host[:idx]
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 }
 
 func (s *TunnelServer) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -115,27 +456,75 @@ func (s *TunnelServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Wait for registration message
+	// Wait for the opening message: either a fresh registration or a
+	// reconnect resuming a previously issued subdomain.
 	_, msg, err := conn.ReadMessage()
 	if err != nil {
 		return
 	}
 
 	var ctrl protocol.ControlMessage
-	if err := json.Unmarshal(msg, &ctrl); err != nil || ctrl.Type != protocol.TypeRegister {
+	if err := json.Unmarshal(msg, &ctrl); err != nil {
 		return
 	}
 
+	switch ctrl.Type {
+	case protocol.TypeRegister:
+		s.handleRegister(conn, r, ctrl)
+	case protocol.TypeReconnect:
+		s.handleReconnect(conn, r, ctrl)
+	}
+}
+
+func (s *TunnelServer) handleRegister(conn *websocket.Conn, r *http.Request, ctrl protocol.ControlMessage) {
 	regData, _ := json.Marshal(ctrl.Payload)
 	var reg protocol.RegisterPayload
 	json.Unmarshal(regData, &reg)
 
+	creds := auth.Credentials{}
+	if reg.Auth != nil {
+		creds.User = reg.Auth.User
+		creds.Pass = reg.Auth.Pass
+		creds.Token = reg.Auth.Token
+	}
+	if creds.Token == "" {
+		creds.Token = r.Header.Get("Sec-WebSocket-Protocol")
+	}
+
+	user, err := s.Auth.Authenticate(creds)
+	if err != nil {
+		log.Printf("Auth rejected: %v", err)
+		conn.WriteJSON(protocol.ControlMessage{
+			Type:    protocol.TypeError,
+			Payload: protocol.ErrorPayload{Message: err.Error()},
+		})
+		return
+	}
+
+	mode := reg.Mode
+	if mode == "" {
+		mode = "http"
+	}
+
 	subdomain := reg.Subdomain
 	if subdomain == "" {
-		subdomain = uuid.New().String()[:8]
+		if user != "" {
+			subdomain = user + "-" + uuid.New().String()[:8]
+		} else {
+			subdomain = uuid.New().String()[:8]
+		}
+	}
+
+	if !s.Auth.AllowedSubdomain(user, subdomain) {
+		log.Printf("Auth rejected: user %q not permitted to claim subdomain %q", user, subdomain)
+		conn.WriteJSON(protocol.ControlMessage{
+			Type:    protocol.TypeError,
+			Payload: protocol.ErrorPayload{Message: fmt.Sprintf("subdomain %q not permitted for user %q", subdomain, user)},
+		})
+		return
 	}
 
-	client := &ClientConn{conn: conn}
+	client := &ClientConn{conn: conn, mode: mode, streams: make(map[uuid.UUID]*tcpStream)}
 
 	s.clientsMu.Lock()
 	if _, exists := s.clients[subdomain]; exists {
@@ -145,23 +534,88 @@ func (s *TunnelServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	s.clients[subdomain] = client
 	s.clientsMu.Unlock()
 
-	log.Printf("Client registered: %s", subdomain)
+	log.Printf("Client registered: %s (mode=%s, user=%q)", subdomain, mode, user)
+
+	if mode == "tcp" {
+		if err := s.startTCPListener(subdomain, client, reg.ListenPort); err != nil {
+			log.Printf("Failed to bind TCP listener for %s: %v", subdomain, err)
+			client.WriteJSON(protocol.ControlMessage{
+				Type:    protocol.TypeRegisterResp,
+				Payload: protocol.RegisterRespPayload{Error: err.Error()},
+			})
+			s.clientsMu.Lock()
+			delete(s.clients, subdomain)
+			s.clientsMu.Unlock()
+			return
+		}
+		defer s.stopTCPListener(subdomain)
+	}
 
 	// Send confirmation
 	scheme := "http"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+	if s.TLSManager != nil || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
 		scheme = "https"
 	}
 	resp := protocol.ControlMessage{
 		Type: protocol.TypeRegisterResp,
 		Payload: protocol.RegisterRespPayload{
-			Subdomain: subdomain,
-			URL:       fmt.Sprintf("%s://%s.%s", scheme, subdomain, s.TunnelDomain),
+			Subdomain:      subdomain,
+			URL:            fmt.Sprintf("%s://%s.%s", scheme, subdomain, s.TunnelDomain),
+			ReconnectToken: s.mintReconnectToken(subdomain),
 		},
 	}
 	client.WriteJSON(resp)
 
-	// Set up health checks
+	s.serveClient(subdomain, client)
+}
+
+// handleReconnect resumes a tunnel whose websocket connection dropped,
+// reattaching conn to the orphaned ClientConn if subdomain and token check
+// out.
+func (s *TunnelServer) handleReconnect(conn *websocket.Conn, r *http.Request, ctrl protocol.ControlMessage) {
+	recData, _ := json.Marshal(ctrl.Payload)
+	var rec protocol.ReconnectPayload
+	json.Unmarshal(recData, &rec)
+
+	s.clientsMu.RLock()
+	client, ok := s.clients[rec.Subdomain]
+	s.clientsMu.RUnlock()
+
+	if !ok || !s.verifyReconnectToken(rec.Subdomain, rec.Token) {
+		conn.WriteJSON(protocol.ControlMessage{
+			Type:    protocol.TypeError,
+			Payload: protocol.ErrorPayload{Message: "reconnect rejected: unknown subdomain or invalid token"},
+		})
+		return
+	}
+
+	client.reattach(conn)
+	log.Printf("Client reconnected: %s", rec.Subdomain)
+
+	s.resendPending(rec.Subdomain, client)
+
+	scheme := "http"
+	if s.TLSManager != nil || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	client.WriteJSON(protocol.ControlMessage{
+		Type: protocol.TypeRegisterResp,
+		Payload: protocol.RegisterRespPayload{
+			Subdomain:      rec.Subdomain,
+			URL:            fmt.Sprintf("%s://%s.%s", scheme, rec.Subdomain, s.TunnelDomain),
+			ReconnectToken: s.mintReconnectToken(rec.Subdomain),
+		},
+	})
+
+	s.serveClient(rec.Subdomain, client)
+}
+
+// serveClient runs the ping loop and read loop shared by both a fresh
+// registration and a reconnect, until the websocket connection drops. On
+// drop, the client is marked orphaned rather than torn down immediately, so
+// a reconnect arriving within the grace period can resume it.
+func (s *TunnelServer) serveClient(subdomain string, client *ClientConn) {
+	conn := client.conn
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -186,32 +640,204 @@ func (s *TunnelServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// Listen for responses or disconnect
 	for {
-		_, msg, err := client.conn.ReadMessage()
+		msgType, msg, err := client.conn.ReadMessage()
 		if err != nil {
-			log.Printf("Client disconnected: %s", subdomain)
-			s.clientsMu.Lock()
-			delete(s.clients, subdomain)
-			s.clientsMu.Unlock()
+			log.Printf("Client disconnected: %s (grace period: %s)", subdomain, s.reconnectGrace())
+			s.orphanClient(subdomain, client)
 			break
 		}
 
+		if msgType == websocket.BinaryMessage {
+			s.handleBinaryFrame(client, msg)
+			continue
+		}
+
 		var respMsg protocol.ControlMessage
 		if err := json.Unmarshal(msg, &respMsg); err != nil {
 			continue
 		}
 
-		if respMsg.Type == protocol.TypeHttpResponse {
+		switch respMsg.Type {
+		case protocol.TypeHttpResponse:
 			data, _ := json.Marshal(respMsg.Payload)
 			var httpResp protocol.HttpResponsePayload
 			json.Unmarshal(data, &httpResp)
 
 			s.reqsMu.RLock()
-			ch, ok := s.pendingReqs[httpResp.ID]
+			pending, ok := s.pendingReqs[httpResp.ID]
 			s.reqsMu.RUnlock()
 
 			if ok {
-				ch <- &httpResp
+				pending.markResponded()
+				pending.header <- &httpResp
+			}
+
+		case protocol.TypeTCPClose:
+			data, _ := json.Marshal(respMsg.Payload)
+			var closePayload protocol.TCPClosePayload
+			json.Unmarshal(data, &closePayload)
+
+			streamID, err := uuid.Parse(closePayload.StreamID)
+			if err != nil {
+				continue
+			}
+			if stream, ok := client.stream(streamID); ok {
+				stream.conn.Close()
+				client.removeStream(streamID)
+			}
+		}
+	}
+}
+
+// orphanClient marks client as orphaned and, unless a reconnect arrives
+// first, deletes it from s.clients once the grace period lapses.
+func (s *TunnelServer) orphanClient(subdomain string, client *ClientConn) {
+	gate := client.markOrphaned()
+	go func() {
+		select {
+		case <-gate.ch:
+			// Reattached (or already expired by someone else); nothing more
+			// to do here.
+		case <-time.After(s.reconnectGrace()):
+			client.expire()
+			s.clientsMu.Lock()
+			delete(s.clients, subdomain)
+			s.clientsMu.Unlock()
+			log.Printf("Client grace period expired, dropping: %s", subdomain)
+		}
+	}()
+}
+
+// startTCPListener binds port on behalf of a "tcp" mode client and, for
+// every accepted connection, allocates a stream ID, announces it with a
+// TCP_OPEN frame, and starts pumping bytes to the client as TCP_DATA
+// frames.
+func (s *TunnelServer) startTCPListener(subdomain string, client *ClientConn, port int) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	s.tcpListenersMu.Lock()
+	s.tcpListeners[subdomain] = ln
+	s.tcpListenersMu.Unlock()
+
+	go func() {
+		for {
+			downstream, err := ln.Accept()
+			if err != nil {
+				return
 			}
+			streamID := uuid.New()
+			client.addStream(streamID, downstream)
+
+			client.WriteJSON(protocol.ControlMessage{
+				Type:    protocol.TypeTCPOpen,
+				Payload: protocol.TCPOpenPayload{StreamID: streamID.String(), Port: port},
+			})
+
+			go s.pumpTCPStream(client, streamID, downstream)
+		}
+	}()
+
+	return nil
+}
+
+func (s *TunnelServer) stopTCPListener(subdomain string) {
+	s.tcpListenersMu.Lock()
+	ln, ok := s.tcpListeners[subdomain]
+	delete(s.tcpListeners, subdomain)
+	s.tcpListenersMu.Unlock()
+	if ok {
+		ln.Close()
+	}
+}
+
+// pumpTCPStream reads from downstream and forwards each chunk to the
+// client as a binary TCP_DATA frame, until downstream closes or errors.
+func (s *TunnelServer) pumpTCPStream(client *ClientConn, streamID uuid.UUID, downstream net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := downstream.Read(buf)
+		if n > 0 {
+			if werr := client.WriteBinary(protocol.EncodeFrame(protocol.FrameTCPData, streamID, buf[:n])); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	client.WriteJSON(protocol.ControlMessage{
+		Type:    protocol.TypeTCPClose,
+		Payload: protocol.TCPClosePayload{StreamID: streamID.String()},
+	})
+	downstream.Close()
+	client.removeStream(streamID)
+}
+
+// handleBinaryFrame decodes a binary frame from a client and routes it to
+// the matching TCP stream or HTTP response body, based on its type.
+func (s *TunnelServer) handleBinaryFrame(client *ClientConn, msg []byte) {
+	ft, id, data, err := protocol.DecodeFrame(msg)
+	if err != nil {
+		return
+	}
+
+	switch ft {
+	case protocol.FrameTCPData:
+		stream, ok := client.stream(uuid.UUID(id))
+		if !ok {
+			return
+		}
+		stream.queue.enqueue(append([]byte(nil), data...))
+
+	case protocol.FrameHTTPBodyChunk:
+		if pending, ok := s.pendingResponse(uuid.UUID(id).String()); ok {
+			pending.bodyQueue.enqueue(append([]byte(nil), data...))
+		}
+
+	case protocol.FrameHTTPBodyEnd:
+		if pending, ok := s.pendingResponse(uuid.UUID(id).String()); ok {
+			pending.bodyQueue.shutdown()
+		}
+	}
+}
+
+func (s *TunnelServer) pendingResponse(reqID string) (*pendingResponse, bool) {
+	s.reqsMu.RLock()
+	defer s.reqsMu.RUnlock()
+	pending, ok := s.pendingReqs[reqID]
+	return pending, ok
+}
+
+// resendPending replays every request still awaiting a response for
+// subdomain to client. It's called right after a reconnect reattaches a
+// client's websocket, so requests that were already dispatched to the
+// previous connection (and are sitting in proxyToClient's select, not just
+// ones that arrived during the orphan window) get resent instead of
+// riding out the gateway timeout.
+func (s *TunnelServer) resendPending(subdomain string, client *ClientConn) {
+	s.reqsMu.RLock()
+	var pendings []*pendingResponse
+	for _, pending := range s.pendingReqs {
+		if pending.subdomain == subdomain {
+			pendings = append(pendings, pending)
+		}
+	}
+	s.reqsMu.RUnlock()
+
+	for _, pending := range pendings {
+		if pending.hasResponded() {
+			// A response already arrived for this request before the
+			// drop, meaning the client already ran it against its local
+			// backend; replaying it again risks duplicating a
+			// non-idempotent request's side effects.
+			continue
+		}
+		if err := pending.resend(client); err != nil {
+			log.Printf("Failed to resend request %s to reconnected client %s: %v", pending.req.ID, subdomain, err)
 		}
 	}
 }
@@ -226,15 +852,29 @@ func (s *TunnelServer) proxyToClient(subdomain string, w http.ResponseWriter, r
 		return
 	}
 
-	reqID := uuid.New().String()
-	body, _ := io.ReadAll(r.Body)
+	if isUpgradeRequest(r) {
+		s.proxyUpgrade(conn, w, r)
+		return
+	}
+
+	if orphaned, gate := conn.orphanState(); orphaned {
+		// The client's websocket dropped but it's still within its
+		// reconnect grace period; hold the request here rather than
+		// failing it, so a reconnect within the window can still serve it.
+		<-gate.ch
+		if orphaned, _ := conn.orphanState(); orphaned {
+			http.Error(w, "Tunnel disconnected", http.StatusBadGateway)
+			return
+		}
+	}
+
+	reqID := uuid.New()
 
 	reqPayload := protocol.HttpRequestPayload{
-		ID:      reqID,
+		ID:      reqID.String(),
 		Method:  r.Method,
 		Path:    r.URL.Path,
 		Headers: r.Header,
-		Body:    body,
 	}
 
 	ctrlMsg := protocol.ControlMessage{
@@ -242,14 +882,14 @@ func (s *TunnelServer) proxyToClient(subdomain string, w http.ResponseWriter, r
 		Payload: reqPayload,
 	}
 
-	respCh := make(chan *protocol.HttpResponsePayload, 1)
+	pending := newPendingResponse(subdomain, reqPayload)
 	s.reqsMu.Lock()
-	s.pendingReqs[reqID] = respCh
+	s.pendingReqs[reqID.String()] = pending
 	s.reqsMu.Unlock()
 
 	defer func() {
 		s.reqsMu.Lock()
-		delete(s.pendingReqs, reqID)
+		delete(s.pendingReqs, reqID.String())
 		s.reqsMu.Unlock()
 	}()
 
@@ -258,17 +898,131 @@ func (s *TunnelServer) proxyToClient(subdomain string, w http.ResponseWriter, r
 		return
 	}
 
-	// Wait for response from client with timeout
+	if err := streamBody(r.Body, func(chunk []byte) error {
+		pending.recordBodyChunk(chunk)
+		return conn.WriteBinary(protocol.EncodeFrame(protocol.FrameHTTPBodyChunk, reqID, chunk))
+	}); err != nil {
+		http.Error(w, "Failed to stream request body to client", http.StatusInternalServerError)
+		return
+	}
+	if err := conn.WriteBinary(protocol.EncodeFrame(protocol.FrameHTTPBodyEnd, reqID, nil)); err != nil {
+		http.Error(w, "Failed to stream request body to client", http.StatusInternalServerError)
+		return
+	}
+
+	// Wait for the response header from the client, with a timeout.
+	var resp *protocol.HttpResponsePayload
 	select {
-	case resp := <-respCh:
-		for k, vv := range resp.Headers {
-			for _, v := range vv {
-				w.Header().Add(k, v)
-			}
-		}
-		w.WriteHeader(resp.Status)
-		w.Write(resp.Body)
+	case resp = <-pending.header:
 	case <-time.After(30 * time.Second):
 		http.Error(w, "Gateway timeout", http.StatusGatewayTimeout)
+		return
+	}
+
+	for k, vv := range resp.Headers {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.Status)
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case chunk, ok := <-pending.chunks:
+			if !ok {
+				return
+			}
+			w.Write(chunk)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-time.After(30 * time.Second):
+			// Client went quiet mid-response (e.g. disconnected); stop
+			// waiting rather than holding this goroutine open forever.
+			return
+		}
+	}
+}
+
+// isUpgradeRequest reports whether r is asking to upgrade its connection
+// (a WebSocket handshake or an HTTP/1.1 "Upgrade: h2c" request), which needs
+// raw byte-stream passthrough instead of the buffered request/response
+// path.
+func isUpgradeRequest(r *http.Request) bool {
+	if !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return false
+	}
+	switch strings.ToLower(r.Header.Get("Upgrade")) {
+	case "websocket", "h2c":
+		return true
+	default:
+		return false
+	}
+}
+
+// proxyUpgrade hijacks the inbound connection and pipes it to the client
+// as a raw byte stream, reusing the TCP_DATA/TCP_CLOSE framing from "tcp"
+// mode tunnels instead of the buffered HTTP request/response path.
+func (s *TunnelServer) proxyUpgrade(client *ClientConn, w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	rawConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "hijack failed", http.StatusInternalServerError)
+		return
+	}
+
+	streamID := uuid.New()
+	client.addStream(streamID, rawConn)
+
+	open := protocol.ControlMessage{
+		Type: protocol.TypeStreamOpen,
+		Payload: protocol.StreamOpenPayload{
+			StreamID: streamID.String(),
+			Method:   r.Method,
+			Path:     r.URL.RequestURI(),
+			Host:     r.Host,
+			Headers:  r.Header,
+		},
+	}
+	if err := client.WriteJSON(open); err != nil {
+		client.removeStream(streamID)
+		rawConn.Close()
+		return
+	}
+
+	// Hijack can leave bytes the server already read off the wire sitting
+	// in its buffer; forward those before pumping the raw connection
+	// directly for everything after.
+	if n := rw.Reader.Buffered(); n > 0 {
+		buf := make([]byte, n)
+		io.ReadFull(rw.Reader, buf)
+		client.WriteBinary(protocol.EncodeFrame(protocol.FrameTCPData, streamID, buf))
+	}
+
+	s.pumpTCPStream(client, streamID, rawConn)
+}
+
+// streamBody reads r in fixed-size chunks, calling send for each one, until
+// EOF or an error.
+func streamBody(r io.Reader, send func([]byte) error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if serr := send(buf[:n]); serr != nil {
+				return serr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
@@ -0,0 +1,48 @@
+package tlsmgr
+
+import (
+	"fmt"
+)
+
+// DNSProvider creates and removes the "_acme-challenge.<fqdn>" TXT record
+// an ACME DNS-01 challenge checks for. fqdn is the domain being validated
+// (e.g. "publictunnel.com" for a "*.publictunnel.com" order) and value is
+// the challenge's key authorization digest.
+type DNSProvider interface {
+	Present(fqdn, value string) error
+	CleanUp(fqdn, value string) error
+}
+
+// NewDNSProvider builds a DNSProvider from the -dns-provider/-dns-credentials
+// flag pair. Only "manual" (credentials is ignored; the operator creates
+// the record themselves) is implemented today; "cloudflare" and "route53"
+// are recognized names reserved for a future real implementation but
+// rejected here rather than advertised as working.
+func NewDNSProvider(name, credentials string) (DNSProvider, error) {
+	switch name {
+	case "cloudflare":
+		return nil, fmt.Errorf("tlsmgr: -dns-provider=cloudflare is not implemented yet; use -dns-provider=manual")
+	case "route53":
+		return nil, fmt.Errorf("tlsmgr: -dns-provider=route53 is not implemented yet; use -dns-provider=manual")
+	case "manual":
+		return ManualProvider{}, nil
+	default:
+		return nil, fmt.Errorf("tlsmgr: unknown -dns-provider %q", name)
+	}
+}
+
+// ManualProvider logs the TXT record the operator needs to create and
+// waits for them to confirm it's in place, for domains without an
+// automatable DNS provider.
+type ManualProvider struct{}
+
+func (ManualProvider) Present(fqdn, value string) error {
+	fmt.Printf("tlsmgr: create a TXT record _acme-challenge.%s with value %q, then press Enter to continue\n", fqdn, value)
+	fmt.Scanln()
+	return nil
+}
+
+func (ManualProvider) CleanUp(fqdn, value string) error {
+	fmt.Printf("tlsmgr: you may now remove the TXT record _acme-challenge.%s (value %q)\n", fqdn, value)
+	return nil
+}
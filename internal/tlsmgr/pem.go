@@ -0,0 +1,36 @@
+package tlsmgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+)
+
+// certRequest builds a DER-encoded CSR for key covering commonName and any
+// additional sans (e.g. a wildcard alongside the apex).
+func certRequest(key *ecdsa.PrivateKey, commonName string, sans ...string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: sans,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
+
+func marshalECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func marshalCertChain(der [][]byte) []byte {
+	var out []byte
+	for _, cert := range der {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+// Package tlsmgr provisions and renews a wildcard TLS certificate for a
+// tunnel domain via ACME DNS-01, since a wildcard like
+// "*.publictunnel.com" can't be satisfied by the HTTP-01 or TLS-ALPN-01
+// challenges that golang.org/x/crypto/acme/autocert speaks natively. This
+// package drives the ACME protocol itself with golang.org/x/crypto/acme
+// and a pluggable DNSProvider for the challenge, but reuses
+// autocert.DirCache for on-disk certificate storage so renewals survive
+// restarts the same way a plain autocert deployment's would.
+package tlsmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// renewBefore is how long before expiry Manager tries to obtain a fresh
+// certificate.
+const renewBefore = 30 * 24 * time.Hour
+
+// Manager obtains and caches a wildcard certificate covering Domain,
+// TunnelDomain and "*.TunnelDomain", restricting issuance to those names
+// plus any subdomain currently present in RegisteredSubdomains.
+type Manager struct {
+	Domain       string
+	TunnelDomain string
+	Email        string
+	CacheDir     string
+	DNS          DNSProvider
+
+	// RegisteredSubdomains returns the subdomains currently claimed by a
+	// connected client, consulted by hostAllowed so the certificate is
+	// not served for revoked/unused subdomains.
+	RegisteredSubdomains func() []string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// NewManager builds a Manager. Call TLSConfig to get a *tls.Config for
+// http.Server.TLSConfig; the first handshake triggers issuance if no
+// cached certificate is found in cacheDir.
+func NewManager(domain, tunnelDomain, email, cacheDir string, dns DNSProvider, registeredSubdomains func() []string) *Manager {
+	return &Manager{
+		Domain:               domain,
+		TunnelDomain:         tunnelDomain,
+		Email:                email,
+		CacheDir:             cacheDir,
+		DNS:                  dns,
+		RegisteredSubdomains: registeredSubdomains,
+	}
+}
+
+// TLSConfig returns a *tls.Config that serves the managed certificate,
+// obtaining (and caching) it on first use.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !m.hostAllowed(hello.ServerName) {
+				return nil, fmt.Errorf("tlsmgr: host %q not permitted a certificate", hello.ServerName)
+			}
+			return m.certificate(hello.Context())
+		},
+	}
+}
+
+// hostAllowed reports whether name may be served the managed wildcard
+// certificate: the apex Domain, the apex TunnelDomain, or a subdomain of
+// TunnelDomain currently claimed by a connected client.
+func (m *Manager) hostAllowed(name string) bool {
+	if name == m.Domain || name == m.TunnelDomain {
+		return true
+	}
+	sub := strings.TrimSuffix(name, "."+m.TunnelDomain)
+	if sub == name {
+		return false
+	}
+	for _, s := range m.RegisteredSubdomains() {
+		if s == sub {
+			return true
+		}
+	}
+	return false
+}
+
+// sans lists the names the managed certificate's ACME order must cover:
+// the tunnel wildcard and apex, plus the separate registration Domain
+// (e.g. "server.publictunnel.com") that hostAllowed also grants the cert
+// to, deduped in case the operator runs both off the same domain.
+func (m *Manager) sans() []string {
+	sans := []string{"*." + m.TunnelDomain, m.TunnelDomain}
+	if m.Domain != m.TunnelDomain {
+		sans = append(sans, m.Domain)
+	}
+	return sans
+}
+
+// certificate returns the cached certificate, obtaining or renewing it
+// first if it's missing or close to expiry.
+func (m *Manager) certificate(ctx context.Context) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cache := autocert.DirCache(m.CacheDir)
+	if m.cert == nil {
+		if data, err := cache.Get(ctx, m.TunnelDomain); err == nil {
+			if cert, err := tls.X509KeyPair(data, data); err == nil && !certExpiringSoon(cert) {
+				m.cert = &cert
+			}
+		}
+	}
+	if m.cert != nil && !certExpiringSoon(*m.cert) {
+		return m.cert, nil
+	}
+
+	cert, pemData, err := m.obtainCertificate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tlsmgr: obtaining certificate: %w", err)
+	}
+	if err := cache.Put(ctx, m.TunnelDomain, pemData); err != nil {
+		return nil, fmt.Errorf("tlsmgr: caching certificate: %w", err)
+	}
+	m.cert = cert
+	return m.cert, nil
+}
+
+func certExpiringSoon(cert tls.Certificate) bool {
+	if len(cert.Certificate) == 0 {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Until(leaf.NotAfter) < renewBefore
+}
+
+// obtainCertificate runs the ACME order/DNS-01/finalize flow for a
+// wildcard covering TunnelDomain (and Domain, if different), returning
+// both the parsed certificate and its PEM encoding (key followed by
+// chain) for caching.
+func (m *Manager) obtainCertificate(ctx context.Context) (*tls.Certificate, []byte, error) {
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating account key: %w", err)
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: acme.LetsEncryptURL}
+
+	account := &acme.Account{Contact: []string{"mailto:" + m.Email}}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil {
+		return nil, nil, fmt.Errorf("registering account: %w", err)
+	}
+
+	sans := m.sans()
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(sans...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("authorizing order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.satisfyAuthorization(ctx, client, authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating certificate key: %w", err)
+	}
+	csr, err := certRequest(certKey, m.TunnelDomain, sans...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("building CSR: %w", err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalizing order: %w", err)
+	}
+
+	keyPEM, err := marshalECKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := marshalCertChain(der)
+	pemData := append(keyPEM, certPEM...)
+
+	cert, err := tls.X509KeyPair(pemData, pemData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing issued certificate: %w", err)
+	}
+	return &cert, pemData, nil
+}
+
+// satisfyAuthorization resolves one order authorization via its dns-01
+// challenge: ask the DNS provider to publish the TXT record, wait for the
+// ACME server to accept it, then clean the record back up.
+func (m *Manager) satisfyAuthorization(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("fetching authorization: %w", err)
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("authorization for %s has no dns-01 challenge", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return fmt.Errorf("computing dns-01 record: %w", err)
+	}
+
+	fqdn := authz.Identifier.Value
+	if err := m.DNS.Present(fqdn, value); err != nil {
+		return fmt.Errorf("publishing dns-01 record for %s: %w", fqdn, err)
+	}
+	defer m.DNS.CleanUp(fqdn, value)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting dns-01 challenge for %s: %w", fqdn, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("waiting on authorization for %s: %w", fqdn, err)
+	}
+	return nil
+}